@@ -0,0 +1,170 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ErrBatchCountMismatch is returned when a BTS or FTS trailer's message
+// count field does not match the number of messages actually read within
+// the block it closes.
+var ErrBatchCountMismatch = errors.New("hl7: batch trailer count does not match messages read")
+
+// BatchReader reads an HL7 batch stream: an optional FHS file header,
+// followed by one or more BHS batch headers each containing multiple MSH
+// messages, closed by BTS and (optionally) FTS trailers. It yields one
+// Message per MSH segment via ReadMessage, transparently tracking the
+// enclosing file/batch headers and validating trailer counts as they're
+// read.
+type BatchReader struct {
+	r    *bufio.Reader
+	next []byte // a segment line already read from r, held for the next call
+
+	fileHeader  Segment
+	batchHeader Segment
+
+	// fieldSep is the separator declared by the most recent FHS or BHS
+	// header, used to parse BTS/FTS trailer fields, which don't redeclare
+	// separators of their own.
+	fieldSep byte
+
+	batchCount int // messages read since the current BHS
+	fileCount  int // messages read since the current FHS
+}
+
+// NewBatchReader returns a BatchReader that reads a batch stream from r.
+func NewBatchReader(r io.Reader) *BatchReader {
+	return &BatchReader{r: bufio.NewReader(r), fieldSep: '|'}
+}
+
+// FileHeader returns the most recently read FHS segment, or the zero
+// Segment if the stream had no file header.
+func (b *BatchReader) FileHeader() Segment {
+	return b.fileHeader
+}
+
+// BatchHeader returns the most recently read BHS segment for the batch
+// currently being read.
+func (b *BatchReader) BatchHeader() Segment {
+	return b.batchHeader
+}
+
+// ReadMessage returns the next message in the batch. FHS, BHS, BTS, and FTS
+// segments are consumed internally rather than returned; ReadMessage
+// returns io.EOF once the stream is exhausted.
+func (b *BatchReader) ReadMessage() (*Message, error) {
+	for {
+		line, err := b.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case bytes.HasPrefix(line, []byte("FHS")):
+			b.setHeader(line, true)
+			b.fileCount = 0
+		case bytes.HasPrefix(line, []byte("BHS")):
+			b.setHeader(line, false)
+			b.batchCount = 0
+		case bytes.HasPrefix(line, []byte("BTS")):
+			if err := b.checkTrailer(line, "BTS", b.batchCount); err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(line, []byte("FTS")):
+			if err := b.checkTrailer(line, "FTS", b.fileCount); err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(line, []byte("MSH")):
+			body, err := b.readMessageBody(line)
+			if err != nil {
+				return nil, err
+			}
+			b.batchCount++
+			b.fileCount++
+			return NewMessage(body)
+		}
+	}
+}
+
+// setHeader records line as the current file or batch header and adopts
+// its declared field separator for parsing subsequent BTS/FTS trailers.
+func (b *BatchReader) setHeader(line []byte, isFile bool) {
+	if len(line) >= 4 {
+		b.fieldSep = line[3]
+	}
+	seg := newSegment(b.fieldSep, '^', '&', '~', '\\', line)
+	if isFile {
+		b.fileHeader = seg
+	} else {
+		b.batchHeader = seg
+	}
+}
+
+// checkTrailer parses the message count out of a BTS/FTS trailer and
+// compares it against got, the number of messages actually read since the
+// matching header.
+func (b *BatchReader) checkTrailer(line []byte, name string, got int) error {
+	fields := bytes.Split(line, []byte{b.fieldSep})
+	if len(fields) < 2 || len(bytes.TrimSpace(fields[1])) == 0 {
+		return nil // the count field is optional in the HL7 spec
+	}
+	want, err := strconv.Atoi(string(bytes.TrimSpace(fields[1])))
+	if err != nil {
+		return fmt.Errorf("hl7: invalid %s count: %w", name, err)
+	}
+	if want != got {
+		return fmt.Errorf("%w: %s declared %d, read %d", ErrBatchCountMismatch, name, want, got)
+	}
+	return nil
+}
+
+// readMessageBody reads the segments following an MSH line up to (but not
+// including) the next MSH/BHS/BTS/FHS/FTS line, which is held in b.next for
+// the following call.
+func (b *BatchReader) readMessageBody(first []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(first)
+
+	for {
+		line, err := b.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if isBatchControlSegment(line) {
+			b.next = line
+			break
+		}
+		buf.WriteByte(CR)
+		buf.Write(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// isBatchControlSegment reports whether line begins a new message or batch
+// envelope segment, rather than belonging to the body of the current
+// message.
+func isBatchControlSegment(line []byte) bool {
+	for _, prefix := range []string{"MSH", "FHS", "BHS", "BTS", "FTS"} {
+		if bytes.HasPrefix(line, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLine returns the next pending segment line, reading a fresh one from
+// the stream if none is held over from readMessageBody.
+func (b *BatchReader) readLine() ([]byte, error) {
+	if b.next != nil {
+		line := b.next
+		b.next = nil
+		return line, nil
+	}
+	return readSegmentLine(b.r)
+}
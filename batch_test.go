@@ -0,0 +1,61 @@
+package hl7
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchReaderReadsMessagesAndTrailers(t *testing.T) {
+	stream := strings.Join([]string{
+		"FHS|^~\\&",
+		"BHS|^~\\&",
+		"MSH|^~\\&|A",
+		"PID|1",
+		"MSH|^~\\&|B",
+		"PID|2",
+		"BTS|2",
+		"FTS|2",
+	}, "\r") + "\r"
+
+	br := NewBatchReader(strings.NewReader(stream))
+
+	msg1, err := br.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, msg1.Parse())
+	val, _ := msg1.Find("MSH.2")
+	assert.Equal(t, "A", val)
+
+	msg2, err := br.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, msg2.Parse())
+	val, _ = msg2.Find("MSH.2")
+	assert.Equal(t, "B", val)
+
+	_, err = br.ReadMessage()
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "FHS", br.FileHeader().Type())
+	assert.Equal(t, "BHS", br.BatchHeader().Type())
+}
+
+func TestBatchReaderTrailerCountMismatch(t *testing.T) {
+	stream := strings.Join([]string{
+		"BHS|^~\\&",
+		"MSH|^~\\&|A",
+		"PID|1",
+		"BTS|2",
+	}, "\r") + "\r"
+
+	br := NewBatchReader(strings.NewReader(stream))
+
+	// The BTS trailer isn't inspected until the call after the message it
+	// closes is read, since it's only discovered while looking for that
+	// message's end.
+	_, err := br.ReadMessage()
+	assert.Nil(t, err)
+
+	_, err = br.ReadMessage()
+	assert.ErrorIs(t, err, ErrBatchCountMismatch)
+}
@@ -0,0 +1,285 @@
+package hl7
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Default encoding characters used when building a message from scratch,
+// matching the values MSH-1/MSH-2 use in the example messages throughout
+// this package's tests.
+const (
+	defaultFieldSep   = '|'
+	defaultCompSep    = '^'
+	defaultSubCompSep = '&'
+	defaultRepeat     = '~'
+	defaultEscape     = '\\'
+)
+
+// ErrNotParsed is returned by (*Message).Marshal when called before Parse.
+var ErrNotParsed = errors.New("hl7: Marshal called before Parse")
+
+// Marshal re-serializes m's already-parsed segments back into HL7 wire
+// format, in the order they were read, using the separators m was decoded
+// with. Parse must be called first.
+func (m *Message) Marshal() ([]byte, error) {
+	if m.order == nil {
+		return nil, ErrNotParsed
+	}
+
+	var buf bytes.Buffer
+	for _, seg := range m.order {
+		buf.WriteString(seg.String())
+		buf.WriteByte(CR)
+	}
+	return buf.Bytes(), nil
+}
+
+// unescape reverses the escape sequences defined by HL7 (\F\, \S\, \T\,
+// \R\, \E\) using m's own separator characters, so that Get/Find return
+// decoded values rather than the raw escaped text.
+func (m *Message) unescape(s string) string {
+	return unescape(s, m.fieldSep, m.compSep, m.subCompSep, m.repeat, m.escape)
+}
+
+// unescape replaces HL7 escape sequences in s with the literal separator
+// character they stand for.
+func unescape(s string, fieldSep, compSep, subCompSep, repeat, escape byte) string {
+	if !strings.ContainsRune(s, rune(escape)) {
+		return s
+	}
+
+	esc := string(escape)
+	r := strings.NewReplacer(
+		esc+"F"+esc, string(fieldSep),
+		esc+"S"+esc, string(compSep),
+		esc+"T"+esc, string(subCompSep),
+		esc+"R"+esc, string(repeat),
+		esc+"E"+esc, esc,
+	)
+	return r.Replace(s)
+}
+
+// escape replaces reserved separator characters in s with their HL7 escape
+// sequence, so the value can be safely placed inside a field/component.
+func escape(s string, fieldSep, compSep, subCompSep, repeat, escape byte) string {
+	esc := string(escape)
+	r := strings.NewReplacer(
+		esc, esc+"E"+esc,
+		string(fieldSep), esc+"F"+esc,
+		string(compSep), esc+"S"+esc,
+		string(subCompSep), esc+"T"+esc,
+		string(repeat), esc+"R"+esc,
+	)
+	return r.Replace(s)
+}
+
+// FieldBuilder accumulates the repeats, components, and subcomponents of a
+// single field, escaping values as they're set.
+type FieldBuilder struct {
+	fieldSep, compSep, subCompSep, repeat, escape byte
+	reps                                          map[int]map[int]map[int]string // rep -> comp -> subComp -> value
+}
+
+func newFieldBuilder(fieldSep, compSep, subCompSep, repeat, escapeCh byte) *FieldBuilder {
+	return &FieldBuilder{
+		fieldSep: fieldSep, compSep: compSep, subCompSep: subCompSep,
+		repeat: repeat, escape: escapeCh,
+		reps: map[int]map[int]map[int]string{},
+	}
+}
+
+// Set stores value at the given component/subcomponent position of the
+// field's first (only) repeat, escaping any reserved separator characters
+// it contains.
+func (f *FieldBuilder) Set(comp, subComp int, value string) {
+	f.SetRep(0, comp, subComp, escape(value, f.fieldSep, f.compSep, f.subCompSep, f.repeat, f.escape))
+}
+
+// SetRaw stores value verbatim at the field's first (only) repeat, without
+// escaping. It's used for content that is already wire-format, such as
+// MSH-2's encoding characters.
+func (f *FieldBuilder) SetRaw(comp, subComp int, value string) {
+	f.SetRep(0, comp, subComp, value)
+}
+
+// SetRep stores value, already escaped if necessary, at the given repeat
+// and component/subcomponent position. It's used for fields with more than
+// one repeat, which Set/SetRaw can't express.
+func (f *FieldBuilder) SetRep(rep, comp, subComp int, value string) {
+	if f.reps[rep] == nil {
+		f.reps[rep] = map[int]map[int]string{}
+	}
+	if f.reps[rep][comp] == nil {
+		f.reps[rep][comp] = map[int]string{}
+	}
+	f.reps[rep][comp][subComp] = value
+}
+
+// String renders the field as HL7 text, joining repeats, components, and
+// subcomponents with their respective separators.
+func (f *FieldBuilder) String() string {
+	maxRep := -1
+	for r := range f.reps {
+		if r > maxRep {
+			maxRep = r
+		}
+	}
+
+	reps := make([]string, maxRep+1)
+	for r := 0; r <= maxRep; r++ {
+		reps[r] = f.repString(f.reps[r])
+	}
+	return strings.Join(reps, string(f.repeat))
+}
+
+// repString renders a single repeat's components/subcomponents.
+func (f *FieldBuilder) repString(comps map[int]map[int]string) string {
+	maxComp := -1
+	for c := range comps {
+		if c > maxComp {
+			maxComp = c
+		}
+	}
+
+	parts := make([]string, maxComp+1)
+	for c := 0; c <= maxComp; c++ {
+		subs := comps[c]
+		maxSub := -1
+		for s := range subs {
+			if s > maxSub {
+				maxSub = s
+			}
+		}
+		subParts := make([]string, maxSub+1)
+		for s := 0; s <= maxSub; s++ {
+			subParts[s] = subs[s]
+		}
+		parts[c] = strings.Join(subParts, string(f.subCompSep))
+	}
+	return strings.Join(parts, string(f.compSep))
+}
+
+// SegmentBuilder builds a single HL7 segment, field by field, for
+// programmatic message construction.
+type SegmentBuilder struct {
+	name                                          string
+	fieldSep, compSep, subCompSep, repeat, escape byte
+	fields                                        map[int]*FieldBuilder
+}
+
+// NewSegmentBuilder returns a SegmentBuilder for a segment of the given
+// name (e.g. "PID"), using the supplied separator characters.
+func NewSegmentBuilder(name string, fieldSep, compSep, subCompSep, repeat, escapeCh byte) *SegmentBuilder {
+	return &SegmentBuilder{
+		name:     name,
+		fieldSep: fieldSep, compSep: compSep, subCompSep: subCompSep,
+		repeat: repeat, escape: escapeCh,
+		fields: map[int]*FieldBuilder{},
+	}
+}
+
+// Field returns the FieldBuilder for the given field sequence, creating it
+// if necessary.
+func (s *SegmentBuilder) Field(seq int) *FieldBuilder {
+	f, ok := s.fields[seq]
+	if !ok {
+		f = newFieldBuilder(s.fieldSep, s.compSep, s.subCompSep, s.repeat, s.escape)
+		s.fields[seq] = f
+	}
+	return f
+}
+
+// Set is a convenience that sets a single comp/subComp value on the field
+// at seq.
+func (s *SegmentBuilder) Set(seq, comp, subComp int, value string) {
+	s.Field(seq).Set(comp, subComp, value)
+}
+
+// Bytes renders the segment as HL7 text, e.g. "PID|||123||Doe^Jane".
+func (s *SegmentBuilder) Bytes() []byte {
+	maxSeq := -1
+	for seq := range s.fields {
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+
+	fields := make([]string, maxSeq+1)
+	fields[0] = s.name
+	for seq := 1; seq <= maxSeq; seq++ {
+		if f, ok := s.fields[seq]; ok {
+			fields[seq] = f.String()
+		}
+	}
+	return []byte(strings.Join(fields, string(s.fieldSep)))
+}
+
+// Marshal builds a new HL7 message from v, a pointer to a struct whose
+// fields are tagged the same way Unmarshal expects:
+// `hl7:"SEG.field.comp.sub"`. Fields are grouped by segment name in the
+// order segments are first encountered, and reserved characters in values
+// are escaped automatically. An MSH segment is always emitted first, with
+// MSH-1/MSH-2 generated from the default encoding characters, whether or
+// not v tags any MSH fields itself, so the result is always a valid,
+// parseable message.
+func Marshal(v interface{}) ([]byte, error) {
+	st := reflect.ValueOf(v)
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("hl7: Marshal requires a struct or pointer to struct, got %s", st.Kind())
+	}
+	stt := st.Type()
+
+	order := []string{"MSH"}
+	builders := map[string]*SegmentBuilder{
+		"MSH": NewSegmentBuilder("MSH", defaultFieldSep, defaultCompSep, defaultSubCompSep, defaultRepeat, defaultEscape),
+	}
+
+	for i := 0; i < st.NumField(); i++ {
+		tag := stt.Field(i).Tag.Get("hl7")
+		if tag == "" {
+			continue
+		}
+		loc := NewLocation(tag)
+
+		b, ok := builders[loc.Segment]
+		if !ok {
+			b = NewSegmentBuilder(loc.Segment, defaultFieldSep, defaultCompSep, defaultSubCompSep, defaultRepeat, defaultEscape)
+			builders[loc.Segment] = b
+			order = append(order, loc.Segment)
+		}
+
+		fv := st.Field(i)
+		if fv.Kind() == reflect.Slice {
+			// Mirrors GetAll/Unmarshal's scalar-slice handling: each element
+			// is a repeat of the same field, joined with the repeat
+			// separator rather than rendered as a Go slice literal.
+			field := b.Field(loc.FieldSeq)
+			for rep := 0; rep < fv.Len(); rep++ {
+				value := fmt.Sprintf("%v", fv.Index(rep).Interface())
+				field.SetRep(rep, loc.Comp, loc.SubComp, escape(value, defaultFieldSep, defaultCompSep, defaultSubCompSep, defaultRepeat, defaultEscape))
+			}
+			continue
+		}
+
+		b.Set(loc.FieldSeq, loc.Comp, loc.SubComp, fmt.Sprintf("%v", fv.Interface()))
+	}
+
+	// MSH-1/MSH-2 are always the generated encoding characters, overriding
+	// any value v happened to tag for them.
+	encChars := string([]byte{defaultCompSep, defaultRepeat, defaultEscape, defaultSubCompSep})
+	builders["MSH"].Field(1).SetRaw(0, 0, encChars)
+
+	var buf bytes.Buffer
+	for _, name := range order {
+		buf.Write(builders[name].Bytes())
+		buf.WriteByte(CR)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,48 @@
+package hl7
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type marshalPID struct {
+	ID       string `hl7:"PID.3.0"`
+	LastName string `hl7:"PID.5.0"`
+}
+
+func TestMarshalAlwaysEmitsMSH(t *testing.T) {
+	out, err := Marshal(&marshalPID{ID: "123", LastName: "Doe"})
+	assert.Nil(t, err)
+
+	// MSH-2 itself holds the encoding characters used to split every other
+	// field, so whether round-tripping it through Find/Get returns the
+	// whole string or just its first component depends on Segment's own
+	// handling of that special case; check the raw bytes instead of relying
+	// on that.
+	assert.Contains(t, string(out), "MSH|^~\\&\r")
+
+	msg, err := NewMessage(out)
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Parse())
+
+	last, err := msg.Find("PID.5")
+	assert.Nil(t, err)
+	assert.Equal(t, "Doe", last)
+}
+
+func TestMarshalEscapesReservedCharacters(t *testing.T) {
+	out, err := Marshal(&marshalPID{ID: "1", LastName: "Smith|Jones"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(out), "Smith\\F\\Jones")
+}
+
+type marshalOBXRepeat struct {
+	Values []string `hl7:"OBX.5.0"`
+}
+
+func TestMarshalRepeatingSliceField(t *testing.T) {
+	out, err := Marshal(&marshalOBXRepeat{Values: []string{"A", "", "C"}})
+	assert.Nil(t, err)
+	assert.Contains(t, string(out), "OBX|||||A~~C\r")
+}
@@ -3,10 +3,13 @@ package hl7
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 )
 
@@ -21,6 +24,7 @@ const (
 // Message is used to describe the parsed message.
 type Message struct {
 	segments   map[string][]Segment
+	order      []Segment // segments in the order they were read, used by Marshal
 	reader     *bufio.Reader
 	lock       sync.Mutex
 	fieldSep   byte
@@ -28,6 +32,56 @@ type Message struct {
 	subCompSep byte
 	repeat     byte
 	escape     byte
+
+	maxSegmentSize int // 0 means unlimited; see SetMaxSegmentSize
+
+	offset   int64              // bytes consumed from reader so far
+	index    map[string][]int64 // segment type -> offsets of its occurrences
+	indexing bool               // whether ReadSegment should record into index; see EnableIndex
+
+	ring []Segment // bounded cache of the most recently read segments
+}
+
+// segmentRingSize bounds the number of recently read segments Message keeps
+// in Ring, regardless of how many segments have been read overall.
+const segmentRingSize = 64
+
+// segBufPool reuses the byte slices ReadSegment accumulates a segment's raw
+// bytes into, so that scanning large batches of segments doesn't thrash the
+// allocator.
+var segBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 256)
+		return &buf
+	},
+}
+
+// ErrSegmentTooLarge is returned by ReadSegment when a segment's raw bytes
+// exceed the configured maximum size before a terminator is seen, guarding
+// against unbounded memory growth from an unterminated stream.
+type ErrSegmentTooLarge struct {
+	Limit int
+}
+
+func (e *ErrSegmentTooLarge) Error() string {
+	return "hl7: segment exceeds maximum size"
+}
+
+// SetMaxSegmentSize bounds the number of bytes ReadSegment will accumulate
+// for a single segment before giving up with an *ErrSegmentTooLarge. A
+// value of 0 (the default) means unlimited.
+func (m *Message) SetMaxSegmentSize(n int) {
+	m.maxSegmentSize = n
+}
+
+// EnableIndex turns recording of each segment's byte offset into Index on
+// or off. It is enabled automatically by Parse, which already pays the
+// cost of materializing every segment. Callers driving ReadSegment, Iter,
+// or Scan directly get no index by default, since building one on every
+// call would defeat the point of streaming through a large file with
+// bounded memory; call EnableIndex(true) first if they want it anyway.
+func (m *Message) EnableIndex(enabled bool) {
+	m.indexing = enabled
 }
 
 // Parse is used to parse the segments within the message so that they can be
@@ -35,6 +89,8 @@ type Message struct {
 // method, which parses the segments as-needed.
 func (m *Message) Parse() error {
 	m.segments = map[string][]Segment{}
+	m.order = nil
+	m.indexing = true
 
 	for {
 		segment, err := m.ReadSegment()
@@ -47,6 +103,7 @@ func (m *Message) Parse() error {
 
 		stype := segment.Type()
 		m.segments[stype] = append(m.segments[stype], segment)
+		m.order = append(m.order, segment)
 	}
 	return nil
 }
@@ -59,21 +116,25 @@ func (m *Message) GetSegment(id string) ([]Segment, error) {
 
 // ReadSegment is used to "read" the next segment from the message.
 func (m *Message) ReadSegment() (Segment, error) {
-	var buf []byte
+	bufp := segBufPool.Get().(*[]byte)
+	buf := (*bufp)[:0]
 
 	m.lock.Lock()
+	start := m.offset
 
+	var tooLarge bool
 	for {
 		b, err := m.reader.ReadByte()
 
 		if err == io.EOF {
 			break
 		}
+		m.offset++
 
 		// Skip all line feeds and character returns while we haven't started saving
 		// bytes to the byte slice. This helps cope with messages that have a lot of
 		// extra whitespace in them.
-		if len(buf) == 0 && unicode.IsSpace(rune(b)) {
+		if len(buf) == 0 && !tooLarge && unicode.IsSpace(rune(b)) {
 			continue
 		}
 
@@ -81,15 +142,109 @@ func (m *Message) ReadSegment() (Segment, error) {
 			break
 		}
 
+		if tooLarge {
+			// Drain the rest of the oversized segment so the next
+			// ReadSegment call starts cleanly at the following segment,
+			// instead of resuming mid-segment and misreading the leftover
+			// bytes as a new one.
+			continue
+		}
+
+		if m.maxSegmentSize > 0 && len(buf) >= m.maxSegmentSize {
+			tooLarge = true
+			continue
+		}
+
+		if len(buf) == 0 {
+			start = m.offset - 1 // the segment's first byte, past any skipped whitespace
+		}
 		buf = append(buf, b)
 	}
 
+	// newSegment needs its own copy since buf's backing array is about to
+	// be returned to the pool for reuse.
+	var owned []byte
+	if !tooLarge && len(buf) > 0 {
+		owned = make([]byte, len(buf))
+		copy(owned, buf)
+	}
+	*bufp = buf
+
+	// The ring and index are shared state read/written by every goroutine
+	// calling ReadSegment concurrently, so their updates have to stay inside
+	// the same critical section as the read loop above, not run after
+	// Unlock.
+	var segment Segment
+	var result error
+	switch {
+	case tooLarge:
+		result = &ErrSegmentTooLarge{Limit: m.maxSegmentSize}
+	case owned == nil:
+		result = io.EOF
+	default:
+		segment = newSegment(m.fieldSep, m.compSep, m.subCompSep, m.repeat, m.escape, owned)
+
+		if m.indexing {
+			stype := segment.Type()
+			if m.index == nil {
+				m.index = map[string][]int64{}
+			}
+			m.index[stype] = append(m.index[stype], start)
+		}
+
+		m.ring = append(m.ring, segment)
+		if len(m.ring) > segmentRingSize {
+			m.ring = m.ring[len(m.ring)-segmentRingSize:]
+		}
+	}
+
 	m.lock.Unlock()
+	segBufPool.Put(bufp)
+
+	return segment, result
+}
+
+// Index returns the byte offsets, within the message's original input, at
+// which each segment type was found. It is only populated when indexing is
+// enabled, either implicitly by Parse or explicitly via EnableIndex.
+func (m *Message) Index() map[string][]int64 {
+	return m.index
+}
+
+// Ring returns the most recently read segments, bounded to the last
+// segmentRingSize entries. Unlike Index, it's always maintained, so it's
+// safe to rely on with Iter/Scan over arbitrarily large streams.
+func (m *Message) Ring() []Segment {
+	return m.ring
+}
 
-	if len(buf) == 0 {
-		return Segment{}, io.EOF
+// Iter streams every segment in the message to fn, in order, without
+// materializing the map Parse builds. Iteration stops at the first error
+// returned by fn or encountered while reading.
+func (m *Message) Iter(fn func(Segment) error) error {
+	for {
+		segment, err := m.ReadSegment()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(segment); err != nil {
+			return err
+		}
 	}
-	return newSegment(m.fieldSep, m.compSep, m.subCompSep, m.repeat, m.escape, buf), nil
+}
+
+// Scan streams only the segments matching segmentType to fn, without
+// materializing the map Parse builds. Segments of other types are skipped,
+// though like every segment read they still pass through the bounded Ring.
+func (m *Message) Scan(segmentType string, fn func(Segment) error) error {
+	return m.Iter(func(segment Segment) error {
+		if segment.Type() != segmentType {
+			return nil
+		}
+		return fn(segment)
+	})
 }
 
 // Find gets a value from a message using location syntax
@@ -102,9 +257,9 @@ func (m *Message) Find(loc string) (string, error) {
 // FindAll gets all values from a message using location syntax
 // finds all occurences of the segments and all repeating fields
 // if the loc is not valid an error is returned
-// func (m *Message) FindAll(loc string) ([]string, error) {
-// 	return m.GetAll(NewLocation(loc))
-// }
+func (m *Message) FindAll(loc string) ([]string, error) {
+	return m.GetAll(NewLocation(loc))
+}
 
 // Get returns the first value specified by the Location
 func (m *Message) Get(l *Location) (string, error) {
@@ -116,53 +271,212 @@ func (m *Message) Get(l *Location) (string, error) {
 		return "", err
 	}
 	sc, _ := seg[0].GetSubComponent(l.FieldSeq, 0, l.Comp, l.SubComp)
-	return sc.String(), err
-}
-
-// GetAll returns all values specified by the Location
-// func (m *Message) GetAll(l *Location) ([]string, error) {
-// 	vals := []string{}
-// 	if l.Segment == "" {
-// 		vals = append(vals, string(m.Value))
-// 		return vals, nil
-// 	}
-// 	segs, err := m.AllSegments(l.Segment)
-// 	if err != nil {
-// 		return vals, err
-// 	}
-// 	for _, s := range segs {
-// 		vs, err := s.GetAll(l)
-// 		if err != nil {
-// 			return vals, err
-// 		}
-// 		vals = append(vals, vs...)
-// 	}
-// 	return vals, nil
-// }
-
-// Unmarshal fills a structure from an HL7 message
-// It will panic if interface{} is not a pointer to a struct
-// Unmarshal will decode the entire message before trying to set values
-// it will set the first matching segment / first matching field
-// repeating segments and fields is not well suited to this
-// for the moment all unmarshal target fields must be strings
+	return m.unescape(sc.String()), err
+}
+
+// maxRepeats bounds how many repeats of a field GetAll will look for, as a
+// safety net against runaway iteration. It relies on GetSubComponent
+// returning an error once rep is out of range; an empty value at a valid
+// repeat index (e.g. the middle of "A~~C") is not on its own a sign that
+// there are no more repeats, so it isn't treated as one.
+const maxRepeats = 50
+
+// GetAll returns every value specified by the Location: each repeat of the
+// field, across every segment matching l.Segment.
+func (m *Message) GetAll(l *Location) ([]string, error) {
+	segs, err := m.GetSegment(l.Segment)
+	if err != nil {
+		return nil, err
+	}
+
+	var vals []string
+	for _, seg := range segs {
+		for rep := 0; rep < maxRepeats; rep++ {
+			sc, err := seg.GetSubComponent(l.FieldSeq, rep, l.Comp, l.SubComp)
+			if err != nil {
+				break
+			}
+			val := m.unescape(sc.String())
+			vals = append(vals, val)
+		}
+	}
+	return vals, nil
+}
+
+// Unmarshal fills a structure from an HL7 message using `hl7:"..."` struct
+// tags. A tag of "SEG.field.comp.sub" sets the first matching field; a
+// slice of scalars with that tag collects every repeat of the field
+// (`~`-separated); a slice of structs tagged with a bare segment name
+// ("OBX") collects one element per occurrence of that segment, with its
+// own fields tagged relative to the segment (".field.comp.sub").
+//
+// Target fields may be string, int/float64/bool (via strconv), or
+// time.Time (parsed as an HL7 TS/DTM value, or with a custom layout given
+// by a `time:"<Go reference layout>"` tag). Unmarshal returns an error
+// naming the tag that failed to parse, rather than silently skipping it.
 func (m *Message) Unmarshal(it interface{}) error {
-	st := reflect.ValueOf(it).Elem()
+	return m.unmarshalStruct(reflect.ValueOf(it).Elem())
+}
+
+// unmarshalStruct fills the exported, hl7-tagged fields of st from the
+// message.
+func (m *Message) unmarshalStruct(st reflect.Value) error {
 	stt := st.Type()
 	for i := 0; i < st.NumField(); i++ {
 		fld := stt.Field(i)
-		r := fld.Tag.Get("hl7")
-		if r != "" {
-			if val, _ := m.Find(r); val != "" {
-				if st.Field(i).CanSet() {
-					// TODO support fields other than string
-					//fldT := st.Field(i).Type()
-					st.Field(i).SetString(strings.TrimSpace(val))
+		tag := fld.Tag.Get("hl7")
+		fv := st.Field(i)
+		if tag == "" || !fv.CanSet() {
+			continue
+		}
+
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct {
+			if err := m.unmarshalSegmentSlice(tag, fv); err != nil {
+				return fmt.Errorf("hl7: unmarshal tag %q: %w", tag, err)
+			}
+			continue
+		}
+
+		loc := NewLocation(tag)
+
+		if fv.Kind() == reflect.Slice {
+			vals, err := m.GetAll(loc)
+			if err != nil {
+				return fmt.Errorf("hl7: unmarshal tag %q: %w", tag, err)
+			}
+			slice := reflect.MakeSlice(fv.Type(), 0, len(vals))
+			for _, val := range vals {
+				ev := reflect.New(fv.Type().Elem()).Elem()
+				if err := setScalar(ev, strings.TrimSpace(val), fld.Tag.Get("time")); err != nil {
+					return fmt.Errorf("hl7: unmarshal tag %q: %w", tag, err)
 				}
+				slice = reflect.Append(slice, ev)
 			}
+			fv.Set(slice)
+			continue
 		}
+
+		val, err := m.Find(tag)
+		if err != nil {
+			return fmt.Errorf("hl7: unmarshal tag %q: %w", tag, err)
+		}
+		if val = strings.TrimSpace(val); val == "" {
+			continue
+		}
+		if err := setScalar(fv, val, fld.Tag.Get("time")); err != nil {
+			return fmt.Errorf("hl7: unmarshal tag %q: %w", tag, err)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalSegmentSlice fills fv, a slice of structs, with one element per
+// occurrence of the segmentType segment.
+func (m *Message) unmarshalSegmentSlice(segmentType string, fv reflect.Value) error {
+	segs, err := m.GetSegment(segmentType)
+	if err != nil {
+		return err
 	}
 
+	slice := reflect.MakeSlice(fv.Type(), 0, len(segs))
+	for _, seg := range segs {
+		elem := reflect.New(fv.Type().Elem()).Elem()
+		if err := m.unmarshalSegmentFields(seg, elem); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem)
+	}
+	fv.Set(slice)
+	return nil
+}
+
+// unmarshalSegmentFields fills the fields of target, tagged relative to a
+// single segment (e.g. `hl7:".3.1"` for field 3, component 1), from seg.
+func (m *Message) unmarshalSegmentFields(seg Segment, target reflect.Value) error {
+	tt := target.Type()
+	for i := 0; i < target.NumField(); i++ {
+		fld := tt.Field(i)
+		tag := fld.Tag.Get("hl7")
+		fv := target.Field(i)
+		if tag == "" || !strings.HasPrefix(tag, ".") || !fv.CanSet() {
+			continue
+		}
+
+		loc := NewLocation("_" + tag)
+		sc, _ := seg.GetSubComponent(loc.FieldSeq, 0, loc.Comp, loc.SubComp)
+		val := strings.TrimSpace(m.unescape(sc.String()))
+		if val == "" {
+			continue
+		}
+		if err := setScalar(fv, val, fld.Tag.Get("time")); err != nil {
+			return fmt.Errorf("tag %q: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+// tsLayouts are the reference layouts tried, in order, when parsing an HL7
+// TS/DTM value ("YYYYMMDDHHMMSS[.ffff][+/-ZZZZ]") into a time.Time without
+// an explicit `time` tag.
+var tsLayouts = []string{
+	"20060102150405.9999-0700",
+	"20060102150405-0700",
+	"20060102150405.9999",
+	"20060102150405",
+	"200601021504",
+	"20060102",
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// setScalar converts val into fv's type, which must be string,
+// int*/float*/bool, or time.Time. layout, if non-empty, is a Go reference
+// layout used to parse time.Time fields instead of the default TS/DTM
+// layouts.
+func setScalar(fv reflect.Value, val, layout string) error {
+	if fv.Type() == timeType {
+		if layout != "" {
+			t, err := time.Parse(layout, val)
+			if err != nil {
+				return err
+			}
+			fv.Set(reflect.ValueOf(t))
+			return nil
+		}
+		for _, l := range tsLayouts {
+			if t, err := time.Parse(l, val); err == nil {
+				fv.Set(reflect.ValueOf(t))
+				return nil
+			}
+		}
+		return fmt.Errorf("value %q does not match any known HL7 TS/DTM layout", val)
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
 	return nil
 }
 
@@ -0,0 +1,244 @@
+package hl7
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// MLLP framing bytes, as defined by the Minimum Lower Layer Protocol used to
+// carry HL7 v2 messages over TCP.
+const (
+	VT = 0x0B // Marks the start of a framed block.
+	FS = 0x1C // Marks the end of a framed block, followed by CR.
+)
+
+// Defaults applied by MLLPReader/MLLPServer when left unconfigured.
+const (
+	defaultMLLPMaxMessage  = 1 << 20 // 1 MiB
+	defaultMLLPReadTimeout = 30 * time.Second
+)
+
+// ErrFrameTooLarge is returned when a frame grows past the configured
+// maximum without being terminated, guarding against unbounded memory use
+// from an unterminated stream.
+var ErrFrameTooLarge = errors.New("hl7: mllp frame exceeds maximum size")
+
+// ErrFrameIncomplete is returned when the underlying stream is closed before
+// a complete <FS><CR> terminator is seen.
+var ErrFrameIncomplete = errors.New("hl7: mllp frame ended before terminator")
+
+// ErrFrameMissingVT is returned when the next byte on the stream is not the
+// expected leading <VT>.
+var ErrFrameMissingVT = errors.New("hl7: mllp frame missing leading VT")
+
+// MLLPReader reads MLLP-framed HL7 messages from a stream, typically a
+// net.Conn, stripping the framing bytes before parsing.
+type MLLPReader struct {
+	r       *bufio.Reader
+	maxSize int
+}
+
+// NewMLLPReader returns an MLLPReader that reads framed messages from r.
+func NewMLLPReader(r io.Reader) *MLLPReader {
+	return &MLLPReader{
+		r:       bufio.NewReader(r),
+		maxSize: defaultMLLPMaxMessage,
+	}
+}
+
+// SetMaxMessageSize bounds the number of payload bytes accepted for a
+// single frame. It defaults to 1 MiB.
+func (r *MLLPReader) SetMaxMessageSize(n int) {
+	r.maxSize = n
+}
+
+// ReadMessage reads the next framed payload from the stream and parses it
+// with NewMessage.
+func (r *MLLPReader) ReadMessage() (*Message, error) {
+	payload, err := r.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(payload)
+}
+
+// readFrame reads one <VT> ... <FS><CR> block and returns the payload with
+// the framing bytes removed.
+func (r *MLLPReader) readFrame() ([]byte, error) {
+	start, err := r.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if start != VT {
+		return nil, ErrFrameMissingVT
+	}
+
+	var buf []byte
+	for {
+		b, err := r.r.ReadByte()
+		if err == io.EOF {
+			return nil, ErrFrameIncomplete
+		} else if err != nil {
+			return nil, err
+		}
+
+		if b == FS {
+			cr, err := r.r.ReadByte()
+			if err == io.EOF {
+				return nil, ErrFrameIncomplete
+			} else if err != nil {
+				return nil, err
+			}
+			if cr != CR {
+				return nil, ErrFrameIncomplete
+			}
+			return buf, nil
+		}
+
+		if len(buf) >= r.maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		buf = append(buf, b)
+	}
+}
+
+// MLLPWriter writes HL7 messages to a stream wrapped in MLLP framing.
+type MLLPWriter struct {
+	w io.Writer
+}
+
+// NewMLLPWriter returns an MLLPWriter that writes framed messages to w.
+func NewMLLPWriter(w io.Writer) *MLLPWriter {
+	return &MLLPWriter{w: w}
+}
+
+// WriteMessage wraps data with the MLLP <VT> ... <FS><CR> framing and
+// writes it to the underlying stream in a single Write call.
+func (w *MLLPWriter) WriteMessage(data []byte) error {
+	framed := make([]byte, 0, len(data)+3)
+	framed = append(framed, VT)
+	framed = append(framed, data...)
+	framed = append(framed, FS, CR)
+	_, err := w.w.Write(framed)
+	return err
+}
+
+// MLLPHandler processes a received Message. A non-nil error causes the
+// server to reply with an AE (application error) ACK instead of AA.
+type MLLPHandler func(*Message) error
+
+// MLLPServer reads MLLP-framed messages from a connection, invokes Handler
+// for each, and writes back an application ACK (or a NAK on framing
+// errors).
+type MLLPServer struct {
+	// Handler is invoked with each message read from the connection.
+	Handler MLLPHandler
+
+	// ReadTimeout bounds how long Serve waits for a frame to arrive or
+	// complete before giving up on the connection. Defaults to 30s.
+	ReadTimeout time.Duration
+
+	// MaxMessageSize bounds the size of a single frame. Defaults to 1 MiB.
+	MaxMessageSize int
+}
+
+// Serve reads messages from conn until the connection is closed or a read
+// error other than a framing error occurs. Framing errors cause a NAK to be
+// sent and the loop to continue, so a sender can retry on the same
+// connection.
+func (s *MLLPServer) Serve(conn net.Conn) error {
+	reader := NewMLLPReader(conn)
+	if s.MaxMessageSize > 0 {
+		reader.SetMaxMessageSize(s.MaxMessageSize)
+	}
+	writer := NewMLLPWriter(conn)
+
+	timeout := s.ReadTimeout
+	if timeout == 0 {
+		timeout = defaultMLLPReadTimeout
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		msg, err := reader.ReadMessage()
+		if err == io.EOF {
+			return nil
+		} else if err == ErrFrameMissingVT || err == ErrFrameIncomplete || err == ErrFrameTooLarge {
+			writer.WriteMessage(buildNAK())
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := msg.Parse(); err != nil {
+			writer.WriteMessage(buildNAK())
+			continue
+		}
+
+		code := "AA"
+		if herr := s.Handler(msg); herr != nil {
+			code = "AE"
+		}
+
+		ack, err := buildACK(msg, code)
+		if err != nil {
+			// msg parsed but can't be acknowledged (e.g. no MSH segment to
+			// reflect MSA back to) - that's a bad application message, not a
+			// reason to tear down the connection.
+			writer.WriteMessage(buildNAK())
+			continue
+		}
+		if err := writer.WriteMessage(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// buildNAK returns a minimal NAK, a bare MSH followed by an AR MSA, used when
+// a frame could not be read or parsed as an HL7 message, or when the parsed
+// message cannot be acknowledged.
+func buildNAK() []byte {
+	return []byte("MSH|^~\\&\rMSA|AR|\r")
+}
+
+// buildACK builds an application ACK/NAK for msg with the given ack code
+// (AA, AE, or AR). The sending/receiving application and facility fields
+// are swapped, and MSH-10 of msg is copied into MSA-2.
+//
+// Field numbers below are the library's own (0-based) indexing, where MSH.0
+// is the literal segment name and all subsequent indices are one less than
+// the standard HL7 field number (MSH-1, the field separator, has no slot of
+// its own).
+func buildACK(msg *Message, code string) ([]byte, error) {
+	// Checked before any Find, which indexes the first MSH segment directly.
+	seg, err := msg.GetSegment("MSH")
+	if err != nil || len(seg) == 0 {
+		return nil, errors.New("hl7: message has no MSH segment to acknowledge")
+	}
+
+	sendingApp, _ := msg.Find("MSH.2")    // MSH-3
+	sendingFac, _ := msg.Find("MSH.3")    // MSH-4
+	receivingApp, _ := msg.Find("MSH.4")  // MSH-5
+	receivingFac, _ := msg.Find("MSH.5")  // MSH-6
+	controlID, _ := msg.Find("MSH.9")     // MSH-10
+	processingID, _ := msg.Find("MSH.10") // MSH-11
+	versionID, _ := msg.Find("MSH.11")    // MSH-12
+
+	fieldSep := string(msg.fieldSep)
+	encChars := string([]byte{msg.compSep, msg.repeat, msg.escape, msg.subCompSep})
+
+	msh := strings.Join([]string{
+		"MSH", encChars, receivingApp, receivingFac, sendingApp, sendingFac,
+		"", "", "ACK", fmt.Sprintf("ACK%d", time.Now().UnixNano()), processingID, versionID,
+	}, fieldSep)
+
+	msa := strings.Join([]string{"MSA", code, controlID}, fieldSep)
+
+	return []byte(msh + "\r" + msa + "\r"), nil
+}
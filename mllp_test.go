@@ -0,0 +1,54 @@
+package hl7
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMLLPWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := NewMLLPWriter(&buf)
+	orig := []byte("MSH|^~\\&|A|B|C|D|20240101||ADT^A01|1|P|2.3")
+	assert.Nil(t, w.WriteMessage(orig))
+
+	r := NewMLLPReader(&buf)
+	msg, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Parse())
+
+	val, _ := msg.Find("MSH.2")
+	assert.Equal(t, "A", val)
+}
+
+func TestMLLPReaderFrameErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"missing leading VT", []byte("MSH|^~\\&"), ErrFrameMissingVT},
+		{"ended without terminator", []byte{VT, 'M', 'S', 'H'}, ErrFrameIncomplete},
+		{"FS not followed by CR", []byte{VT, 'M', 'S', 'H', FS, 'X'}, ErrFrameIncomplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewMLLPReader(bytes.NewReader(tt.data))
+			_, err := r.ReadMessage()
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestMLLPReaderMaxMessageSize(t *testing.T) {
+	data := append([]byte{VT}, []byte("MSH|^~\\&")...)
+	data = append(data, FS, CR)
+
+	r := NewMLLPReader(bytes.NewReader(data))
+	r.SetMaxMessageSize(3)
+
+	_, err := r.ReadMessage()
+	assert.Equal(t, ErrFrameTooLarge, err)
+}
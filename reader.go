@@ -0,0 +1,80 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Reader reads one or more HL7 messages from a stream, splitting the
+// stream into messages on MSH segment boundaries.
+type Reader struct {
+	r    *bufio.Reader
+	next []byte // a segment line already read from r, held for the next message
+}
+
+// NewReader returns a Reader that reads messages from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// ReadMessage reads and returns the next message in the stream. It returns
+// io.EOF once there are no more messages to read.
+func (r *Reader) ReadMessage() (*Message, error) {
+	first := r.next
+	r.next = nil
+
+	if first == nil {
+		line, err := readSegmentLine(r.r)
+		if err != nil {
+			return nil, err
+		}
+		first = line
+	}
+
+	var buf bytes.Buffer
+	buf.Write(first)
+
+	for {
+		line, err := readSegmentLine(r.r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(line, []byte("MSH")) {
+			r.next = line
+			break
+		}
+		buf.WriteByte(CR)
+		buf.Write(line)
+	}
+
+	return NewMessage(buf.Bytes())
+}
+
+// readSegmentLine reads the next non-empty, CR/LF-terminated line from r,
+// with the terminator stripped. It is shared by Reader and BatchReader.
+func readSegmentLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil, io.EOF
+			}
+			return line, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if b == CR || b == LF {
+			if len(line) == 0 {
+				continue
+			}
+			return line, nil
+		}
+
+		line = append(line, b)
+	}
+}
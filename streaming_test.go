@@ -0,0 +1,65 @@
+package hl7
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSegmentIndexIsOptIn(t *testing.T) {
+	msg, err := NewMessage([]byte("MSH|^~\\&\rOBX|1\rOBX|2\r"))
+	assert.Nil(t, err)
+
+	count := 0
+	assert.Nil(t, msg.Iter(func(Segment) error {
+		count++
+		return nil
+	}))
+
+	assert.Equal(t, 3, count)
+	assert.Nil(t, msg.Index())
+}
+
+func TestReadSegmentIndexWhenEnabled(t *testing.T) {
+	msg, err := NewMessage([]byte("MSH|^~\\&\rOBX|1\rOBX|2\r"))
+	assert.Nil(t, err)
+	msg.EnableIndex(true)
+
+	assert.Nil(t, msg.Iter(func(Segment) error { return nil }))
+	assert.Len(t, msg.Index()["OBX"], 2)
+}
+
+func TestReadSegmentRingIsBounded(t *testing.T) {
+	var data []byte
+	data = append(data, []byte("MSH|^~\\&\r")...)
+	for i := 0; i < segmentRingSize*2; i++ {
+		data = append(data, []byte("OBX|1\r")...)
+	}
+
+	msg, err := NewMessage(data)
+	assert.Nil(t, err)
+
+	assert.Nil(t, msg.Iter(func(Segment) error { return nil }))
+	assert.Len(t, msg.Ring(), segmentRingSize)
+	assert.Nil(t, msg.Index())
+}
+
+func TestReadSegmentTooLargeResyncsStream(t *testing.T) {
+	msg, err := NewMessage([]byte("MSH|^~\\&\rPID|1234567890"))
+	assert.Nil(t, err)
+	msg.SetMaxSegmentSize(5)
+
+	_, err = msg.ReadSegment() // MSH is already over the 5-byte limit
+	assert.IsType(t, &ErrSegmentTooLarge{}, err)
+
+	// The rest of the oversized MSH segment must have been drained, so this
+	// call sees the PID segment (also over the limit) rather than treating
+	// its leftover bytes as a bogus new segment.
+	seg, err := msg.ReadSegment()
+	assert.IsType(t, &ErrSegmentTooLarge{}, err)
+	assert.Equal(t, Segment{}, seg)
+
+	_, err = msg.ReadSegment()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,56 @@
+package hl7
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAllKeepsEmptyMiddleRepeat(t *testing.T) {
+	msg, err := NewMessage([]byte("MSH|^~\\&\rNTE|1|A~~C"))
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Parse())
+
+	vals, err := msg.FindAll("NTE.2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"A", "", "C"}, vals)
+}
+
+type unmarshalOBX struct {
+	Value float64 `hl7:".5.0"`
+}
+
+type unmarshalTarget struct {
+	LastName string         `hl7:"PID.5.0"`
+	DOB      time.Time      `hl7:"PID.7.0"`
+	Obs      []unmarshalOBX `hl7:"OBX"`
+}
+
+func TestUnmarshalTypedFields(t *testing.T) {
+	msg, err := NewMessage([]byte("MSH|^~\\&\rPID|1||||Doe||19800101\rOBX|1|NM|||59\rOBX|2|NM|||61"))
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Parse())
+
+	var target unmarshalTarget
+	assert.Nil(t, msg.Unmarshal(&target))
+
+	assert.Equal(t, "Doe", target.LastName)
+	assert.Equal(t, 1980, target.DOB.Year())
+	assert.Equal(t, []unmarshalOBX{{Value: 59}, {Value: 61}}, target.Obs)
+}
+
+func TestUnmarshalWrapsScalarConversionError(t *testing.T) {
+	type badTarget struct {
+		Value int `hl7:"PID.7.0"`
+	}
+
+	msg, err := NewMessage([]byte("MSH|^~\\&\rPID|1||||||notanumber"))
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Parse())
+
+	var target badTarget
+	err = msg.Unmarshal(&target)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "PID.7.0")
+}